@@ -1,6 +1,8 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/siddontang/moonmq/proto"
 	"net"
@@ -29,32 +31,87 @@ type Conn struct {
 	lastHeartbeat int64
 
 	channels map[string]*Channel
+
+	subscribers map[string]*subscriber
+
+	state         ConnState
+	reconnectCond *sync.Cond
+
+	tokenMu  sync.Mutex
+	token    string
+	tokenExp time.Time
+}
+
+// defaultDialer dials network unless addr looks like a unix socket path
+// (the historical convention for cfg.BrokerAddr), in which case it dials
+// unix instead. Custom cfg.Dialer implementations are not subject to this
+// rewrite.
+func defaultDialer(ctx context.Context, network, addr string) (net.Conn, error) {
+	if strings.Contains(addr, "/") {
+		network = "unix"
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// dial opens the underlying transport for cfg.BrokerAddr using cfg.Dialer
+// if set, falling back to defaultDialer otherwise, then wraps the result
+// in a TLS handshake when cfg.TLS is configured.
+func dial(cfg *Config) (net.Conn, error) {
+	dialer := cfg.Dialer
+	if dialer == nil {
+		dialer = defaultDialer
+	}
+
+	conn, err := dialer(context.Background(), "tcp", cfg.BrokerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TLS != nil {
+		tc := tls.Client(conn, cfg.TLS)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+
+	return conn, nil
 }
 
 func newConn(client *Client) (*Conn, error) {
+	return newConnToAddr(client, client.cfg.BrokerAddr)
+}
+
+// newConnToAddr is newConn for a specific broker address, used by the
+// broker pool to dial addresses from cfg.BrokerAddrs rather than the
+// single cfg.BrokerAddr.
+func newConnToAddr(client *Client, addr string) (*Conn, error) {
 	c := new(Conn)
 
 	c.client = client
-	c.cfg = client.cfg
 
-	var n string = "tcp"
-	if strings.Contains(c.cfg.BrokerAddr, "/") {
-		n = "unix"
-	}
+	cfg := *client.cfg
+	cfg.BrokerAddr = addr
+	c.cfg = &cfg
+
+	c.reconnectCond = sync.NewCond(&c.Mutex)
 
 	var err error
-	if c.conn, err = net.Dial(n, c.cfg.BrokerAddr); err != nil {
+	if c.conn, err = dial(c.cfg); err != nil {
 		return nil, err
 	}
 
 	c.decoder = proto.NewDecoder(c.conn)
 
 	c.grab = make(chan struct{}, 1)
-	c.grab <- struct{}{}
+	c.wait = make(chan *proto.Proto, 1)
 
 	c.channels = make(map[string]*Channel)
 
-	c.wait = make(chan *proto.Proto, 1)
+	c.subscribers = make(map[string]*subscriber)
 
 	c.closed = false
 
@@ -76,56 +133,148 @@ func (c *Conn) Close() {
 }
 
 func (c *Conn) close() {
-	c.conn.Close()
+	c.Lock()
 	c.closed = true
-}
+	c.state = StateClosed
 
-func (c *Conn) run() {
-	defer func() {
-		c.conn.Close()
+	// Unblock anything waiting on the current response (requestContext) or
+	// on the reconnect gate (reconnectCond), the same way a dropped
+	// connection already does in handleDisconnect.
+	oldWait := c.wait
+	c.wait = make(chan *proto.Proto, 1)
+	c.Unlock()
+
+	close(oldWait)
+	c.reconnectCond.Broadcast()
 
-		close(c.wait)
+	c.conn.Close()
+}
 
-		c.closed = true
-	}()
+func (c *Conn) run() {
 	for {
 		p, err := c.decoder.Decode()
 		if err != nil {
+			if c.handleDisconnect() {
+				continue
+			}
 			return
 		}
 
 		if p.Method == proto.Push {
 			queueName := p.Queue()
 			c.Lock()
+			sub, hasSub := c.subscribers[queueName]
 			ch, ok := c.channels[queueName]
-			if !ok {
-				c.Unlock()
+			c.Unlock()
+
+			if hasSub {
+				sub.deliver(p.MsgId(), p.Body)
+			} else if ok {
+				ch.pushMsg(p.MsgId(), p.Body)
+			} else {
 				return
 			}
+		} else {
+			c.Lock()
+			waitCh := c.wait
 			c.Unlock()
 
-			ch.pushMsg(p.MsgId(), p.Body)
-		} else {
-			c.wait <- p
+			waitCh <- p
 		}
 
 	}
 }
 
 func (c *Conn) request(p *proto.Proto, expectMethod uint32) (*proto.Proto, error) {
-	<-c.grab
+	return c.requestContext(context.Background(), p, expectMethod)
+}
+
+// requestContext is request but honors ctx.Done() at every wait point:
+// waiting out a reconnect, acquiring the grab token and waiting on the
+// response.
+//
+// Concurrency is deliberately out of scope here: the wire protocol gives a
+// response no way to identify which request it answers, so multiplexing
+// multiple in-flight requests over one Conn isn't possible without a
+// broker-side change this series doesn't make. requestContext keeps the
+// pre-existing single-grab serialization; ctx buys a deadline/cancellation
+// on top of that, not concurrency.
+//
+// A reconnect (or close) swaps in a fresh wait channel and closes the old
+// one, so a requestContext call that was blocked on a response when the
+// connection dropped fails instead of hanging until a reply that will
+// never arrive.
+func (c *Conn) requestContext(ctx context.Context, p *proto.Proto, expectMethod uint32) (*proto.Proto, error) {
+	c.Lock()
+	if c.state == StateReconnecting {
+		// Wake the Wait below when ctx is done, not only when the
+		// reconnect finishes.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Lock()
+				c.reconnectCond.Broadcast()
+				c.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for c.state == StateReconnecting {
+		select {
+		case <-ctx.Done():
+			c.Unlock()
+			return nil, ctx.Err()
+		default:
+		}
+
+		c.reconnectCond.Wait()
+	}
 
-	err := c.writeProto(p)
+	if c.closed {
+		c.Unlock()
+		return nil, fmt.Errorf("connection closed")
+	}
+
+	grabCh := c.grab
+	waitCh := c.wait
+	c.Unlock()
 
-	c.grab <- struct{}{}
+	select {
+	case grabCh <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 
-	if err != nil {
+	if err := c.writeProto(p); err != nil {
+		<-grabCh
 		return nil, err
 	}
 
-	rp, ok := <-c.wait
-	if !ok {
-		return nil, fmt.Errorf("wait channel closed")
+	var rp *proto.Proto
+	select {
+	case <-ctx.Done():
+		// Detach waitCh from the Conn before releasing grab, so the
+		// response run() is still going to deliver lands on the now
+		// orphaned channel instead of being handed to the next request
+		// that grabs in. grabCh is released immediately either way: a
+		// stuck broker that never replies must not wedge every later
+		// request on this Conn behind an abandoned one.
+		c.Lock()
+		if c.wait == waitCh {
+			c.wait = make(chan *proto.Proto, 1)
+		}
+		c.Unlock()
+
+		<-grabCh
+		return nil, ctx.Err()
+	case p, ok := <-waitCh:
+		<-grabCh
+		if !ok {
+			return nil, fmt.Errorf("connection closed")
+		}
+		rp = p
 	}
 
 	if rp.Method == proto.Error {
@@ -157,16 +306,76 @@ func (c *Conn) writeProto(p *proto.Proto) error {
 	return nil
 }
 
+// requestFunc is the shape of request and syncRequest, letting auth and
+// rebindAll run either over the normal run()-dispatched path or, during a
+// reconnect, directly against the decoder on the goroutine that would
+// otherwise be running run().
+type requestFunc func(p *proto.Proto, expectMethod uint32) (*proto.Proto, error)
+
+// auth authenticates the connection. A configured TokenProvider takes
+// precedence and is used for JWT auth; otherwise a configured passMD5
+// falls back to the original password auth; if neither is set, auth is
+// skipped entirely.
 func (c *Conn) auth() error {
+	return c.authContext(context.Background())
+}
+
+// authContext is auth, but passed down to TokenProvider so a caller with a
+// deadline or cancellation can give up on a stuck token fetch instead of
+// blocking auth indefinitely.
+func (c *Conn) authContext(ctx context.Context) error {
+	return c.authWith(ctx, c.request)
+}
+
+// authWith is authContext parameterized on how the auth request is sent and
+// its response awaited, so reconnect can reuse the same auth logic over
+// syncRequest instead of request. See requestFunc.
+func (c *Conn) authWith(ctx context.Context, do requestFunc) error {
+	if c.cfg.TokenProvider != nil {
+		return c.authJWTWith(ctx, do)
+	}
+
 	if len(c.client.passMD5) == 0 {
 		return nil
 	}
 
 	p := proto.NewAuthProto(c.client.passMD5)
-	_, err := c.request(p.P, proto.Auth_OK)
+	_, err := do(p.P, proto.Auth_OK)
 	return err
 }
 
+// syncRequest writes p and reads directly off c.decoder, without going
+// through run()'s dispatch loop, until a non-Push response arrives; Push
+// messages read in the meantime are discarded, and a response that is not
+// expectMethod is returned as an error. It is
+// only safe to call from the goroutine that would otherwise be running
+// run() — during reconnect, before run() resumes reading — since it is not
+// synchronized with run() at all.
+func (c *Conn) syncRequest(p *proto.Proto, expectMethod uint32) (*proto.Proto, error) {
+	if err := c.writeProto(p); err != nil {
+		return nil, err
+	}
+
+	for {
+		rp, err := c.decoder.Decode()
+		if err != nil {
+			return nil, err
+		}
+
+		if rp.Method == proto.Push {
+			continue
+		}
+
+		if rp.Method == proto.Error {
+			return nil, fmt.Errorf("error:%v, code:%d", rp.Body, rp.Fields[proto.CodeStr])
+		} else if rp.Method != expectMethod {
+			return nil, fmt.Errorf("invalid return method %d != %d", rp.Method, expectMethod)
+		}
+
+		return rp, nil
+	}
+}
+
 func (c *Conn) keepalive() error {
 	n := time.Now().Unix()
 
@@ -180,9 +389,15 @@ func (c *Conn) keepalive() error {
 }
 
 func (c *Conn) Publish(queue string, routingKey string, body []byte, pubType string) (int64, error) {
+	return c.PublishContext(context.Background(), queue, routingKey, body, pubType)
+}
+
+// PublishContext is Publish but returns ctx.Err() if ctx is done before the
+// broker acknowledges the publish.
+func (c *Conn) PublishContext(ctx context.Context, queue string, routingKey string, body []byte, pubType string) (int64, error) {
 	p := proto.NewPublishProto(queue, routingKey, pubType, body)
 
-	np, err := c.request(p.P, proto.Publish_OK)
+	np, err := c.requestContext(ctx, p.P, proto.Publish_OK)
 	if err != nil {
 		return 0, err
 	}
@@ -191,6 +406,12 @@ func (c *Conn) Publish(queue string, routingKey string, body []byte, pubType str
 }
 
 func (c *Conn) Bind(queue string, routingKey string, noAck bool) (*Channel, error) {
+	return c.BindContext(context.Background(), queue, routingKey, noAck)
+}
+
+// BindContext is Bind but returns ctx.Err() if ctx is done before the
+// broker acknowledges the bind.
+func (c *Conn) BindContext(ctx context.Context, queue string, routingKey string, noAck bool) (*Channel, error) {
 	c.Lock()
 	ch, ok := c.channels[queue]
 	if !ok {
@@ -209,7 +430,7 @@ func (c *Conn) Bind(queue string, routingKey string, noAck bool) (*Channel, erro
 
 	p := proto.NewBindProto(queue, routingKey, noAck)
 
-	rp, err := c.request(p.P, proto.Bind_OK)
+	rp, err := c.requestContext(ctx, p.P, proto.Bind_OK)
 
 	if err != nil {
 		return nil, err
@@ -258,6 +479,19 @@ func (c *Conn) unbind(queue string) error {
 }
 
 func (c *Conn) ack(queue string, msgId string) error {
+	return c.AckContext(context.Background(), queue, msgId)
+}
+
+// AckContext is ack but returns ctx.Err() instead of writing the ack if
+// ctx is already done. Acking is fire-and-forget (the broker sends no
+// reply), so ctx only guards the write itself.
+func (c *Conn) AckContext(ctx context.Context, queue string, msgId string) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
 	p := proto.NewAckProto(queue, msgId)
 
 	return c.writeProto(p.P)
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siddontang/moonmq/proto"
+)
+
+// newTestConn wires up a bare Conn around one end of a net.Pipe, with run()
+// already started, so request/requestContext can be exercised without a
+// real broker or the Client/Config plumbing that dials one.
+func newTestConn(t *testing.T, conn net.Conn) *Conn {
+	c := &Conn{
+		cfg:         &Config{},
+		conn:        conn,
+		decoder:     proto.NewDecoder(conn),
+		grab:        make(chan struct{}, 1),
+		wait:        make(chan *proto.Proto, 1),
+		channels:    make(map[string]*Channel),
+		subscribers: make(map[string]*subscriber),
+	}
+	c.reconnectCond = sync.NewCond(&c.Mutex)
+
+	go c.run()
+
+	return c
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	c := newTestConn(t, clientSide)
+
+	go func() {
+		dec := proto.NewDecoder(serverSide)
+		req, err := dec.Decode()
+		if err != nil {
+			return
+		}
+
+		resp := proto.NewProto(proto.Bind_OK, map[string]string{proto.QueueStr: req.Queue()}, nil)
+		buf, err := proto.Marshal(resp)
+		if err != nil {
+			return
+		}
+		serverSide.Write(buf)
+	}()
+
+	p := proto.NewBindProto("test_queue", "", false)
+	rp, err := c.request(p.P, proto.Bind_OK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rp.Queue() != "test_queue" {
+		t.Fatalf("got queue %q, want %q", rp.Queue(), "test_queue")
+	}
+}
+
+// TestRequestContextCancelReleasesGrab checks that a canceled
+// requestContext frees the grab token without waiting for its (now
+// unwanted) response, so the next request on the Conn doesn't hang behind
+// it.
+func TestRequestContextCancelReleasesGrab(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	c := newTestConn(t, clientSide)
+
+	respond := make(chan struct{})
+	go func() {
+		dec := proto.NewDecoder(serverSide)
+		for i := 0; i < 2; i++ {
+			req, err := dec.Decode()
+			if err != nil {
+				return
+			}
+
+			if i == 0 {
+				<-respond
+			}
+
+			resp := proto.NewProto(proto.Bind_OK, map[string]string{proto.QueueStr: req.Queue()}, nil)
+			buf, err := proto.Marshal(resp)
+			if err != nil {
+				return
+			}
+			serverSide.Write(buf)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p := proto.NewBindProto("q1", "", false)
+	if _, err := c.requestContext(ctx, p.P, proto.Bind_OK); err != context.Canceled {
+		t.Fatalf("got err %v, want context.Canceled", err)
+	}
+
+	close(respond)
+
+	done := make(chan error, 1)
+	go func() {
+		p2 := proto.NewBindProto("q2", "", false)
+		_, err := c.request(p2.P, proto.Bind_OK)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request after a canceled requestContext did not complete: grab token was never released")
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/siddontang/moonmq/proto"
+	"strings"
+	"time"
+)
+
+// tokenRefreshSkew is how long before a cached JWT's exp claim it is
+// refreshed, so a request doesn't race a token expiring mid-flight.
+const tokenRefreshSkew = 30 * time.Second
+
+// authJWT authenticates using the token returned by cfg.TokenProvider,
+// refreshing the cached token if it is missing or close to expiry.
+func (c *Conn) authJWT() error {
+	return c.authJWTWith(context.Background(), c.request)
+}
+
+// authJWTWith is authJWT parameterized on how the auth request is sent; see
+// requestFunc. ctx is passed down to cfg.TokenProvider so a caller-supplied
+// deadline or cancellation reaches the token fetch, not just the auth
+// request itself.
+func (c *Conn) authJWTWith(ctx context.Context, do requestFunc) error {
+	token, err := c.validToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	p := proto.NewAuthJWTProto(token)
+	_, err = do(p.P, proto.Auth_OK)
+	return err
+}
+
+// validToken returns a cached JWT that won't expire within
+// tokenRefreshSkew, fetching a fresh one from cfg.TokenProvider otherwise.
+// ctx governs only the TokenProvider call; a cache hit never touches it.
+func (c *Conn) validToken(ctx context.Context) (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.token != "" && (c.tokenExp.IsZero() || time.Until(c.tokenExp) > tokenRefreshSkew) {
+		return c.token, nil
+	}
+
+	token, err := c.cfg.TokenProvider(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	exp, err := jwtExpiry(token)
+	if err != nil {
+		return "", err
+	}
+
+	c.token = token
+	c.tokenExp = exp
+
+	return token, nil
+}
+
+// jwtExpiry extracts the exp claim from a JWT without verifying its
+// signature; verification is the broker's job, the client only needs exp
+// to know when to refresh. A token with no exp claim is treated as never
+// expiring, rather than as already expired.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("moonmq: malformed JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("moonmq: decode JWT payload: %v", err)
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("moonmq: parse JWT claims: %v", err)
+	}
+
+	if claims.Exp == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(claims.Exp, 0), nil
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func makeJWT(t *testing.T, exp int64) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+
+	claims, err := json.Marshal(struct {
+		Exp int64 `json:"exp"`
+	}{exp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+
+	return header + "." + payload + ".sig"
+}
+
+func TestJwtExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+
+	got, err := jwtExpiry(makeJWT(t, exp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Unix() != exp {
+		t.Fatalf("got %v, want unix time %d", got, exp)
+	}
+}
+
+func TestJwtExpiryNoExpClaim(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{}`))
+
+	got, err := jwtExpiry(header + "." + payload + ".sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.IsZero() {
+		t.Fatalf("got %v, want zero time for a token with no exp claim", got)
+	}
+}
+
+func TestJwtExpiryMalformed(t *testing.T) {
+	if _, err := jwtExpiry("not-a-jwt"); err == nil {
+		t.Fatal("expected an error for a malformed token")
+	}
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BrokerScorer computes a rendezvous (HRW) score for a candidate broker and
+// a routing key. The broker pool routes a key to the broker with the
+// highest score, so swapping the scorer (e.g. for consistent hashing)
+// changes the routing strategy without touching the pool itself.
+type BrokerScorer func(brokerAddr string, key string) uint64
+
+// DefaultBrokerScorer hashes brokerAddr, a NUL separator and key with
+// FNV-1a. It doesn't need
+// to be cryptographically strong, only fast and well distributed.
+func DefaultBrokerScorer(brokerAddr string, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(brokerAddr))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+type brokerEntry struct {
+	sync.Mutex
+
+	addr    string
+	healthy bool
+	conn    *Conn
+}
+
+// brokerPool picks a broker per publish key using rendezvous hashing over
+// cfg.BrokerAddrs, and evicts brokers whose dial or publish fails until a
+// later health probe reaches them again.
+type brokerPool struct {
+	sync.RWMutex
+
+	client  *Client
+	scorer  BrokerScorer
+	entries []*brokerEntry
+
+	probeInterval time.Duration
+	stop          chan struct{}
+}
+
+func newBrokerPool(client *Client, addrs []string, scorer BrokerScorer) *brokerPool {
+	if scorer == nil {
+		scorer = DefaultBrokerScorer
+	}
+
+	p := &brokerPool{
+		client:        client,
+		scorer:        scorer,
+		probeInterval: 5 * time.Second,
+		stop:          make(chan struct{}),
+	}
+
+	for _, addr := range addrs {
+		p.entries = append(p.entries, &brokerEntry{addr: addr, healthy: true})
+	}
+
+	go p.healthCheckLoop()
+
+	return p
+}
+
+// rank returns the healthy broker entries for key, ordered from the
+// highest rendezvous score to the lowest.
+func (p *brokerPool) rank(key string) ([]*brokerEntry, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	ranked := make([]*brokerEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		e.Lock()
+		healthy := e.healthy
+		e.Unlock()
+
+		if healthy {
+			ranked = append(ranked, e)
+		}
+	}
+
+	if len(ranked) == 0 {
+		return nil, fmt.Errorf("moonmq: no healthy brokers available")
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		return p.scorer(ranked[i].addr, key) > p.scorer(ranked[j].addr, key)
+	})
+
+	return ranked, nil
+}
+
+// getConn returns a connected Conn for e, dialing lazily on first use and
+// whenever the cached Conn has gone away.
+func (e *brokerEntry) getConn(client *Client) (*Conn, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.conn != nil && e.conn.State() != StateClosed {
+		return e.conn, nil
+	}
+
+	c, err := newConnToAddr(client, e.addr)
+	if err != nil {
+		e.healthy = false
+		return nil, err
+	}
+
+	e.conn = c
+	return c, nil
+}
+
+func (p *brokerPool) healthCheckLoop() {
+	ticker := time.NewTicker(p.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.probeUnhealthy()
+		}
+	}
+}
+
+func (p *brokerPool) probeUnhealthy() {
+	p.RLock()
+	entries := make([]*brokerEntry, len(p.entries))
+	copy(entries, p.entries)
+	p.RUnlock()
+
+	for _, e := range entries {
+		e.Lock()
+		down := !e.healthy
+		e.Unlock()
+
+		if !down {
+			continue
+		}
+
+		// A raw dial is enough to confirm the broker is back; routing
+		// through newConnToAddr here would spin up a full Conn (and its
+		// run() goroutine) on every successful probe and leak it, since
+		// nothing ever closes it.
+		cfg := *p.client.cfg
+		cfg.BrokerAddr = e.addr
+
+		conn, err := dial(&cfg)
+		if err == nil {
+			conn.Close()
+
+			e.Lock()
+			e.healthy = true
+			e.Unlock()
+		}
+	}
+}
+
+func (p *brokerPool) close() {
+	close(p.stop)
+}
+
+// Publish picks a broker for queue+routingKey via rendezvous hashing and
+// publishes to it, falling back to the next-highest scoring broker if the
+// connection or the publish itself fails.
+func (p *brokerPool) Publish(queue string, routingKey string, body []byte, pubType string) (int64, error) {
+	ranked, err := p.rank(queue + routingKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var lastErr error
+	for _, e := range ranked {
+		c, err := e.getConn(p.client)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		n, err := c.Publish(queue, routingKey, body, pubType)
+		if err != nil {
+			e.Lock()
+			e.healthy = false
+			e.Unlock()
+			lastErr = err
+			continue
+		}
+
+		return n, nil
+	}
+
+	return 0, lastErr
+}
@@ -0,0 +1,188 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/siddontang/moonmq/proto"
+)
+
+func TestDefaultBrokerScorerDeterministic(t *testing.T) {
+	s1 := DefaultBrokerScorer("127.0.0.1:11181", "queue_a")
+	s2 := DefaultBrokerScorer("127.0.0.1:11181", "queue_a")
+
+	if s1 != s2 {
+		t.Fatalf("scorer is not deterministic: %d != %d", s1, s2)
+	}
+}
+
+func TestDefaultBrokerScorerVariesByBroker(t *testing.T) {
+	s1 := DefaultBrokerScorer("127.0.0.1:11181", "queue_a")
+	s2 := DefaultBrokerScorer("127.0.0.1:11182", "queue_a")
+
+	if s1 == s2 {
+		t.Fatal("expected different brokers to score a key differently")
+	}
+}
+
+func TestDefaultBrokerScorerVariesByKey(t *testing.T) {
+	s1 := DefaultBrokerScorer("127.0.0.1:11181", "queue_a")
+	s2 := DefaultBrokerScorer("127.0.0.1:11181", "queue_b")
+
+	if s1 == s2 {
+		t.Fatal("expected different keys to score against the same broker differently")
+	}
+}
+
+// fixedScorer scores brokerAddr by a caller-supplied table, ignoring key,
+// so a test can pin rank()'s ordering instead of depending on FNV-1a's
+// actual distribution.
+func fixedScorer(scores map[string]uint64) BrokerScorer {
+	return func(brokerAddr string, key string) uint64 {
+		return scores[brokerAddr]
+	}
+}
+
+func TestRankOrdersByScoreDescending(t *testing.T) {
+	p := &brokerPool{
+		scorer: fixedScorer(map[string]uint64{
+			"a": 1,
+			"b": 3,
+			"c": 2,
+		}),
+		entries: []*brokerEntry{
+			{addr: "a", healthy: true},
+			{addr: "b", healthy: true},
+			{addr: "c", healthy: true},
+		},
+	}
+
+	ranked, err := p.rank("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{ranked[0].addr, ranked[1].addr, ranked[2].addr}
+	want := []string{"b", "c", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got rank order %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRankExcludesUnhealthyAndErrorsWhenNoneLeft(t *testing.T) {
+	p := &brokerPool{
+		scorer: DefaultBrokerScorer,
+		entries: []*brokerEntry{
+			{addr: "a", healthy: false},
+			{addr: "b", healthy: true},
+		},
+	}
+
+	ranked, err := p.rank("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranked) != 1 || ranked[0].addr != "b" {
+		t.Fatalf("got ranked %v, want only %q", ranked, "b")
+	}
+
+	p.entries[1].healthy = false
+	if _, err := p.rank("key"); err == nil {
+		t.Fatal("expected an error when no broker is healthy")
+	}
+}
+
+// fakeBroker accepts one connection and replies Publish_OK to every
+// Publish request it decodes, so pool.Publish can be driven end to end
+// without a real broker binary.
+func fakeBroker(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		dec := proto.NewDecoder(conn)
+		for {
+			_, err := dec.Decode()
+			if err != nil {
+				return
+			}
+
+			resp := proto.NewProto(proto.Publish_OK, nil, []byte("1"))
+			buf, err := proto.Marshal(resp)
+			if err != nil {
+				return
+			}
+			conn.Write(buf)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestPublishFailsOverToNextBroker(t *testing.T) {
+	badAddr := "127.0.0.1:1" // nothing listens here; dialing it fails fast.
+	goodAddr := fakeBroker(t)
+
+	client := &Client{cfg: &Config{}}
+
+	p := &brokerPool{
+		client: client,
+		scorer: fixedScorer(map[string]uint64{
+			badAddr:  2,
+			goodAddr: 1,
+		}),
+		entries: []*brokerEntry{
+			{addr: badAddr, healthy: true},
+			{addr: goodAddr, healthy: true},
+		},
+	}
+
+	n, err := p.Publish("q", "", []byte("hi"), "direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %d, want 1", n)
+	}
+
+	p.RLock()
+	bad := p.entries[0]
+	p.RUnlock()
+
+	bad.Lock()
+	healthy := bad.healthy
+	bad.Unlock()
+
+	if healthy {
+		t.Fatal("expected the broker Publish failed over from to be marked unhealthy")
+	}
+}
+
+func TestProbeUnhealthyReenablesReachableBroker(t *testing.T) {
+	addr := fakeBroker(t)
+
+	p := &brokerPool{
+		client:  &Client{cfg: &Config{}},
+		entries: []*brokerEntry{{addr: addr, healthy: false}},
+	}
+
+	p.probeUnhealthy()
+
+	p.entries[0].Lock()
+	defer p.entries[0].Unlock()
+
+	if !p.entries[0].healthy {
+		t.Fatal("expected a reachable broker to be marked healthy again")
+	}
+}
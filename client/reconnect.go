@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/siddontang/moonmq/proto"
+	"math/rand"
+	"time"
+)
+
+// ConnState describes the lifecycle state of a Conn.
+type ConnState int
+
+const (
+	StateConnected ConnState = iota
+	StateReconnecting
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the current lifecycle state of the connection.
+func (c *Conn) State() ConnState {
+	c.Lock()
+	defer c.Unlock()
+	return c.state
+}
+
+// handleDisconnect is called from run() after a Decode error. It marks the
+// connection as reconnecting, fires OnDisconnect, and attempts to redial
+// and re-establish every bound queue with backoff. It returns true if the
+// connection was restored and run() should keep reading, false if the
+// connection should be considered permanently closed.
+func (c *Conn) handleDisconnect() bool {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return false
+	}
+	c.state = StateReconnecting
+
+	// Swap in a fresh wait channel and close the old one so any
+	// requestContext call blocked on a response from the dead connection
+	// fails now instead of hanging until a reply that will never arrive.
+	oldWait := c.wait
+	c.wait = make(chan *proto.Proto, 1)
+	c.Unlock()
+
+	close(oldWait)
+
+	c.conn.Close()
+
+	if c.cfg.OnDisconnect != nil {
+		c.cfg.OnDisconnect(c)
+	}
+
+	err := c.reconnect()
+
+	c.Lock()
+	if err != nil {
+		c.state = StateClosed
+		c.closed = true
+		c.Unlock()
+
+		c.reconnectCond.Broadcast()
+		return false
+	}
+	c.state = StateConnected
+	c.Unlock()
+
+	c.reconnectCond.Broadcast()
+
+	if c.cfg.OnReconnect != nil {
+		c.cfg.OnReconnect(c)
+	}
+
+	return true
+}
+
+// reconnect redials c.cfg.BrokerAddr with exponential backoff and jitter,
+// re-authenticates and re-binds every queue still in c.channels.
+func (c *Conn) reconnect() error {
+	base := c.cfg.ReconnectBackoffBase
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+	cap := c.cfg.ReconnectBackoffCap
+	if cap <= 0 {
+		cap = 30 * time.Second
+	}
+
+	backoff := base
+	for attempt := 0; c.cfg.MaxReconnectAttempts == 0 || attempt < c.cfg.MaxReconnectAttempts; attempt++ {
+		if attempt > 0 {
+			jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+			sleep := backoff + jitter
+			if sleep > cap {
+				sleep = cap
+			}
+			time.Sleep(sleep)
+
+			backoff *= 2
+			if backoff > cap {
+				backoff = cap
+			}
+		}
+
+		conn, err := dial(c.cfg)
+		if err != nil {
+			continue
+		}
+
+		c.Lock()
+		c.conn = conn
+		c.decoder = proto.NewDecoder(conn)
+		c.Unlock()
+
+		// reconnect runs on the same goroutine that would otherwise be
+		// running run(), so auth and rebindAll must drive the decoder
+		// directly via syncRequest rather than request/requestContext,
+		// which wait on run() to dispatch their responses and would
+		// deadlock against themselves here.
+		if err = c.authWith(context.Background(), c.syncRequest); err != nil {
+			conn.Close()
+			continue
+		}
+
+		if err = c.rebindAllWith(c.syncRequest); err != nil {
+			conn.Close()
+			continue
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("reconnect to %s: max attempts exceeded", c.cfg.BrokerAddr)
+}
+
+// rebindAll re-issues Bind for every queue the caller still holds a
+// Channel for, so existing Channel handles keep working after a reconnect.
+func (c *Conn) rebindAll() error {
+	return c.rebindAllWith(c.request)
+}
+
+// rebindAllWith is rebindAll parameterized on how each bind request is
+// sent; see requestFunc.
+func (c *Conn) rebindAllWith(do requestFunc) error {
+	c.Lock()
+	queues := make(map[string]*Channel, len(c.channels))
+	for q, ch := range c.channels {
+		queues[q] = ch
+	}
+	c.Unlock()
+
+	for queue, ch := range queues {
+		p := proto.NewBindProto(queue, ch.routingKey, ch.noAck)
+
+		rp, err := do(p.P, proto.Bind_OK)
+		if err != nil {
+			return err
+		}
+
+		if rp.Queue() != queue {
+			return fmt.Errorf("invalid bind response queue %s", rp.Queue())
+		}
+	}
+
+	return nil
+}
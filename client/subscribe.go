@@ -0,0 +1,325 @@
+package client
+
+import (
+	"errors"
+	"sync"
+)
+
+// errBacklogFull is passed to onError when a message is dropped because a
+// subscriber's backlog hit WithQueueSize's limit under OverflowDropNewest
+// or OverflowDropOldest.
+var errBacklogFull = errors.New("moonmq: subscriber backlog full")
+
+// Message is a single message delivered to a Subscribe handler.
+type Message struct {
+	Queue      string
+	RoutingKey string
+	Id         string
+	Body       []byte
+}
+
+// Subscriber represents an active handler-based subscription created by
+// Conn.Subscribe. Unsubscribe stops delivery and drains any handlers that
+// are still running before unbinding the queue.
+type Subscriber interface {
+	// Topic returns the queue this subscriber is bound to.
+	Topic() string
+
+	// Unsubscribe stops delivery, waits for in-flight handlers to finish
+	// and unbinds the queue.
+	Unsubscribe() error
+}
+
+// SubOption configures a Subscribe call.
+type SubOption func(*subOptions)
+
+type subOptions struct {
+	workers  int
+	queue    int
+	noAck    bool
+	overflow OverflowPolicy
+	onError  func(msg *Message, err error)
+}
+
+func newSubOptions() *subOptions {
+	return &subOptions{
+		workers: 1,
+		queue:   64,
+	}
+}
+
+// OverflowPolicy controls what deliver does with a message that arrives
+// while a subscriber's backlog already holds WithQueueSize undelivered
+// messages.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock, the default, keeps every message: the backlog grows
+	// past WithQueueSize rather than lose one. A subscriber whose handler
+	// never catches up grows its backlog without bound, but delivery never
+	// blocks the Conn's run() goroutine the way blocking the channel send
+	// directly would.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropNewest discards the arriving message, leaving the
+	// backlog's existing contents untouched. onError, if set, is called
+	// with errBacklogFull.
+	OverflowDropNewest
+
+	// OverflowDropOldest discards the oldest backlogged message to make
+	// room for the arriving one. onError, if set, is called with
+	// errBacklogFull for the dropped message.
+	OverflowDropOldest
+)
+
+// WithOverflowPolicy sets what happens to a message that arrives once a
+// subscriber's backlog already holds WithQueueSize undelivered messages.
+// The default is OverflowBlock.
+func WithOverflowPolicy(p OverflowPolicy) SubOption {
+	return func(o *subOptions) {
+		o.overflow = p
+	}
+}
+
+// WithWorkers sets how many goroutines run the handler concurrently.
+// The default is 1, which preserves per-queue message ordering.
+func WithWorkers(n int) SubOption {
+	return func(o *subOptions) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
+
+// WithQueueSize sets how many undelivered messages may accumulate in a
+// subscriber's backlog before WithOverflowPolicy's policy kicks in.
+func WithQueueSize(n int) SubOption {
+	return func(o *subOptions) {
+		if n > 0 {
+			o.queue = n
+		}
+	}
+}
+
+// WithNoAck disables automatic acking of successfully handled messages,
+// mirroring the noAck flag accepted by Bind.
+func WithNoAck() SubOption {
+	return func(o *subOptions) {
+		o.noAck = true
+	}
+}
+
+// WithErrorHandler registers a callback invoked whenever the handler
+// returns an error. If unset, handler errors are silently dropped and the
+// message is left unacked for redelivery.
+func WithErrorHandler(f func(msg *Message, err error)) SubOption {
+	return func(o *subOptions) {
+		o.onError = f
+	}
+}
+
+// subscriber runs a user handler in a managed pool of goroutines fed by
+// messages the broker pushes for its queue.
+//
+// deliver is called inline from Conn.run(), so it must never block: it
+// only ever appends to backlog under relayMu and signals relayCond. A
+// single relay goroutine drains backlog into msgs, which is what the
+// worker pool actually reads from, so a slow handler only ever stalls
+// relay, never run().
+type subscriber struct {
+	c  *Conn
+	ch *Channel
+
+	queue      string
+	routingKey string
+	noAck      bool
+
+	handler  func(msg *Message) error
+	onError  func(msg *Message, err error)
+	overflow OverflowPolicy
+
+	relayMu    sync.Mutex
+	relayCond  *sync.Cond
+	backlog    []*Message
+	maxBacklog int
+
+	msgs chan *Message
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	closedMu sync.Mutex
+	closed   bool
+}
+
+// Subscribe binds queue/routingKey like Bind, but delivers messages to
+// handler on a managed goroutine pool instead of requiring the caller to
+// poll the Channel. Unless WithNoAck is given, each message is acked
+// automatically after handler returns nil for it.
+func (c *Conn) Subscribe(queue string, routingKey string, handler func(msg *Message) error, opts ...SubOption) (Subscriber, error) {
+	o := newSubOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ch, err := c.Bind(queue, routingKey, o.noAck)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &subscriber{
+		c:          c,
+		ch:         ch,
+		queue:      queue,
+		routingKey: routingKey,
+		noAck:      o.noAck,
+		handler:    handler,
+		onError:    o.onError,
+		overflow:   o.overflow,
+		maxBacklog: o.queue,
+		msgs:       make(chan *Message, o.queue),
+		quit:       make(chan struct{}),
+	}
+	s.relayCond = sync.NewCond(&s.relayMu)
+
+	c.Lock()
+	c.subscribers[queue] = s
+	c.Unlock()
+
+	s.wg.Add(1)
+	go s.relay()
+
+	for i := 0; i < o.workers; i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+
+	return s, nil
+}
+
+// deliver is called inline from Conn.run() and must never block it. It
+// only ever appends to backlog (subject to overflow) and signals the relay
+// goroutine, which is the one that may block handing messages to the
+// worker pool.
+func (s *subscriber) deliver(msgId string, body []byte) {
+	msg := &Message{
+		Queue:      s.queue,
+		RoutingKey: s.routingKey,
+		Id:         msgId,
+		Body:       body,
+	}
+
+	s.relayMu.Lock()
+
+	if len(s.backlog) >= s.maxBacklog {
+		switch s.overflow {
+		case OverflowDropNewest:
+			s.relayMu.Unlock()
+			if s.onError != nil {
+				s.onError(msg, errBacklogFull)
+			}
+			return
+		case OverflowDropOldest:
+			dropped := s.backlog[0]
+			s.backlog = append(s.backlog[:0], s.backlog[1:]...)
+			s.backlog = append(s.backlog, msg)
+			s.relayMu.Unlock()
+
+			if s.onError != nil {
+				s.onError(dropped, errBacklogFull)
+			}
+			s.relayCond.Signal()
+			return
+		}
+	}
+
+	s.backlog = append(s.backlog, msg)
+	s.relayMu.Unlock()
+
+	s.relayCond.Signal()
+}
+
+// relay drains backlog into msgs on its own goroutine, so a worker pool
+// that can't keep up blocks relay instead of Conn.run().
+func (s *subscriber) relay() {
+	defer s.wg.Done()
+
+	for {
+		s.relayMu.Lock()
+		for len(s.backlog) == 0 {
+			select {
+			case <-s.quit:
+				s.relayMu.Unlock()
+				return
+			default:
+			}
+			s.relayCond.Wait()
+		}
+
+		msg := s.backlog[0]
+		s.backlog = append(s.backlog[:0], s.backlog[1:]...)
+		s.relayMu.Unlock()
+
+		select {
+		case s.msgs <- msg:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *subscriber) work() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case msg, ok := <-s.msgs:
+			if !ok {
+				return
+			}
+			s.handle(msg)
+		}
+	}
+}
+
+func (s *subscriber) handle(msg *Message) {
+	err := s.handler(msg)
+	if err != nil {
+		if s.onError != nil {
+			s.onError(msg, err)
+		}
+		return
+	}
+
+	if !s.noAck {
+		s.c.ack(msg.Queue, msg.Id)
+	}
+}
+
+func (s *subscriber) Topic() string {
+	return s.queue
+}
+
+func (s *subscriber) Unsubscribe() error {
+	s.closedMu.Lock()
+	if s.closed {
+		s.closedMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closedMu.Unlock()
+
+	s.c.Lock()
+	delete(s.c.subscribers, s.queue)
+	s.c.Unlock()
+
+	close(s.quit)
+
+	// Wake relay out of relayCond.Wait(), if it's parked there, so it
+	// observes s.quit instead of waiting for a backlog that may never come.
+	s.relayCond.Broadcast()
+	s.wg.Wait()
+
+	return s.c.unbind(s.queue)
+}
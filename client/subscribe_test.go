@@ -0,0 +1,98 @@
+package client
+
+import (
+	"sync"
+	"testing"
+)
+
+func newTestSubscriber(maxBacklog int, overflow OverflowPolicy, onError func(*Message, error)) *subscriber {
+	s := &subscriber{
+		queue:      "q",
+		maxBacklog: maxBacklog,
+		overflow:   overflow,
+		onError:    onError,
+		msgs:       make(chan *Message, maxBacklog),
+		quit:       make(chan struct{}),
+	}
+	s.relayCond = sync.NewCond(&s.relayMu)
+	return s
+}
+
+// TestDeliverDropNewest checks that deliver, which is called inline from
+// Conn.run() and must never block it, discards the arriving message once
+// the backlog is full.
+func TestDeliverDropNewest(t *testing.T) {
+	var dropped []string
+	s := newTestSubscriber(2, OverflowDropNewest, func(msg *Message, err error) {
+		dropped = append(dropped, msg.Id)
+	})
+
+	s.deliver("1", nil)
+	s.deliver("2", nil)
+	s.deliver("3", nil)
+
+	if len(s.backlog) != 2 || s.backlog[0].Id != "1" || s.backlog[1].Id != "2" {
+		t.Fatalf("got backlog %v, want [1 2]", s.backlog)
+	}
+
+	if len(dropped) != 1 || dropped[0] != "3" {
+		t.Fatalf("got dropped %v, want [3]", dropped)
+	}
+}
+
+func TestDeliverDropOldest(t *testing.T) {
+	var dropped []string
+	s := newTestSubscriber(2, OverflowDropOldest, func(msg *Message, err error) {
+		dropped = append(dropped, msg.Id)
+	})
+
+	s.deliver("1", nil)
+	s.deliver("2", nil)
+	s.deliver("3", nil)
+
+	if len(s.backlog) != 2 || s.backlog[0].Id != "2" || s.backlog[1].Id != "3" {
+		t.Fatalf("got backlog %v, want [2 3]", s.backlog)
+	}
+
+	if len(dropped) != 1 || dropped[0] != "1" {
+		t.Fatalf("got dropped %v, want [1]", dropped)
+	}
+}
+
+// TestDeliverBlockGrowsBacklog covers the default OverflowBlock policy:
+// deliver keeps every message past maxBacklog rather than drop one.
+func TestDeliverBlockGrowsBacklog(t *testing.T) {
+	s := newTestSubscriber(1, OverflowBlock, nil)
+
+	s.deliver("1", nil)
+	s.deliver("2", nil)
+	s.deliver("3", nil)
+
+	if len(s.backlog) != 3 {
+		t.Fatalf("got backlog length %d, want 3", len(s.backlog))
+	}
+}
+
+// TestRelayDrainsBacklog covers the relay goroutine handing backlogged
+// messages to the worker-facing msgs channel without deliver ever touching
+// msgs directly.
+func TestRelayDrainsBacklog(t *testing.T) {
+	s := newTestSubscriber(4, OverflowBlock, nil)
+
+	s.wg.Add(1)
+	go s.relay()
+
+	s.deliver("1", nil)
+	s.deliver("2", nil)
+
+	for _, want := range []string{"1", "2"} {
+		msg := <-s.msgs
+		if msg.Id != want {
+			t.Fatalf("got id %q, want %q", msg.Id, want)
+		}
+	}
+
+	close(s.quit)
+	s.relayCond.Broadcast()
+	s.wg.Wait()
+}